@@ -0,0 +1,98 @@
+package throttler
+
+import (
+	"math"
+	"time"
+)
+
+const (
+	// minAutoTuneSamples is the minimum amount of samples per
+	// interval the auto-tuning aims for.
+	minAutoTuneSamples = 5
+	// minAutoTuneStep is the smallest ST the auto-tuning picks, CPU
+	// times reported by the OS do not have a finer resolution.
+	minAutoTuneStep = 10 * time.Millisecond
+)
+
+// AutoTune configures the automatic tuning of T and ST. At the end of every
+// interval the variance of the samples is used to compute how many samples
+// are needed for the average CPU usage to have the configured precision.
+// T is then set to the shortest duration, at least MinInterval, that fits
+// those samples when sampling as fast as the OS resolution allows, which
+// keeps the controller as responsive as the noise allows. ST is picked to
+// spread those samples over T, so stable signals are sampled less often
+// and noisy ones more often.
+type AutoTune struct {
+	// MinInterval is the shortest T that can be picked.
+	MinInterval time.Duration
+	// MaxInterval is the longest T that can be picked.
+	MaxInterval time.Duration
+	// Precision is the wanted standard error of the average CPU usage of
+	// an interval, in CPU usage points.
+	Precision float64
+}
+
+// NewAutoTuned creates a new throttler with the specified parameters that
+// tunes T and ST automatically, starting with T=1s and ST=100ms.
+func NewAutoTuned(cpuLimit, k float64) *T {
+	t := New(cpuLimit, k, time.Second, 100*time.Millisecond)
+	t.AutoTune = &AutoTune{
+		MinInterval: 500 * time.Millisecond,
+		MaxInterval: 10 * time.Second,
+		Precision:   1,
+	}
+	return t
+}
+
+// autoTune adjusts the intervals based on the samples of the interval
+// that just ended. Invalid configurations keep the current intervals.
+// The caller must hold t.smu.
+func (t *T) autoTune(stats []float64, avg float64) {
+	at := t.AutoTune
+	if at == nil || at.Precision <= 0 || at.MaxInterval <= 0 || at.MaxInterval < at.MinInterval {
+		return
+	}
+
+	var variance float64
+	for _, stat := range stats {
+		variance += (stat - avg) * (stat - avg)
+	}
+	if len(stats) > 1 {
+		variance /= float64(len(stats) - 1)
+	}
+	if math.IsNaN(variance) || math.IsInf(variance, 0) {
+		return
+	}
+
+	// the standard error of the mean is sqrt(variance/n), n is clamped
+	// to the amount of samples that fit in the longest interval
+	n := math.Ceil(variance / (at.Precision * at.Precision))
+	if max := float64(at.MaxInterval / minAutoTuneStep); n > max {
+		n = max
+	}
+	if n < minAutoTuneSamples {
+		n = minAutoTuneSamples
+	}
+
+	// computed as a float so it can not overflow before being clamped
+	interval := at.MaxInterval
+	if d := n * float64(minAutoTuneStep); d < float64(at.MaxInterval) {
+		interval = time.Duration(d)
+	}
+	if interval < at.MinInterval {
+		interval = at.MinInterval
+	}
+
+	step := interval / time.Duration(n)
+	if step < minAutoTuneStep {
+		step = minAutoTuneStep
+	}
+	if max := interval / minAutoTuneSamples; step > max {
+		step = max
+	}
+	if interval <= 0 || step <= 0 {
+		return
+	}
+
+	t.interval, t.intervalStep = interval, step
+}
@@ -0,0 +1,42 @@
+package throttler
+
+import "sync/atomic"
+
+// capacityAlpha is the smoothing factor of the exponentially weighted
+// moving average used for the capacity estimation.
+const capacityAlpha = 0.3
+
+// Capacity returns an estimate of the requests per second the instance can
+// sustain while keeping the CPU usage at L. Every T the rate of allowed
+// requests is compared against the achieved CPU usage and, assuming CPU usage
+// grows linearly with the rate, extrapolated to L. It returns 0 until an
+// estimate is available.
+func (t *T) Capacity() float64 {
+	t.smu.Lock()
+	defer t.smu.Unlock()
+	return t.capacity
+}
+
+// estimateCapacity updates the capacity estimation with the amount of
+// requests admitted during the interval and its average CPU usage.
+// The caller must hold t.smu.
+func (t *T) estimateCapacity(admitted uint64, avg float64) {
+	if admitted == 0 || avg <= 0 || t.interval <= 0 {
+		return
+	}
+
+	rate := float64(admitted) / t.interval.Seconds()
+	estimate := rate * t.L / avg
+	if t.capacity == 0 {
+		t.capacity = estimate
+		return
+	}
+	t.capacity = capacityAlpha*estimate + (1-capacityAlpha)*t.capacity
+}
+
+// resetCounters discards the allowed requests and the results reported so
+// far, so they are not attributed to the first interval of a new state.
+func (t *T) resetCounters() {
+	atomic.StoreUint64(&t.admitted, 0)
+	t.swapResults()
+}
@@ -0,0 +1,35 @@
+package throttler
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+)
+
+// ErrYield is the error returned by CheckIn when the throttler is under
+// severe pressure and the caller should yield or terminate gracefully.
+var ErrYield = errors.New("throttler is under severe pressure, request should yield")
+
+// CheckIn is meant to be called periodically by long-lived requests such
+// as streams, WebSockets or big downloads, which are only gated by Allow
+// when they start. It returns ctx.Err() if ctx is done and ErrYield if the
+// request should yield or terminate gracefully to relieve the pressure.
+// Requests are asked to yield only when R is at or below YieldR, with a
+// probability that grows as R approaches 0.
+func (t *T) CheckIn(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if t.YieldR <= 0 {
+		return nil
+	}
+
+	r := *(*float64)(atomic.LoadPointer(&t.r))
+	if r > t.YieldR {
+		return nil
+	}
+	if t.float64()*t.YieldR >= r {
+		return ErrYield
+	}
+	return nil
+}
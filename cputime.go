@@ -0,0 +1,62 @@
+package throttler
+
+import "github.com/shirou/gopsutil/v3/cpu"
+
+// CPUTime is a set of categories of CPU time as reported by the OS.
+type CPUTime uint16
+
+// Categories of CPU time that can be counted as busy. Guest time is not
+// one of them since the OS already accounts for it within user and nice.
+const (
+	CPUUser CPUTime = 1 << iota
+	CPUNice
+	CPUSystem
+	CPUIowait
+	CPUIrq
+	CPUSoftirq
+	CPUSteal
+)
+
+// DefaultBusyCPUTimes counts every category but idle as busy. On virtualized
+// hosts this over-counts: steal is time taken by other guests and iowait is
+// idle time waiting for I/O, so they are usually worth excluding, e.g.
+// DefaultBusyCPUTimes &^ (CPUSteal | CPUIowait).
+const DefaultBusyCPUTimes = CPUUser | CPUNice | CPUSystem | CPUIowait | CPUIrq |
+	CPUSoftirq | CPUSteal
+
+// usage returns the % of CPU time in st that was busy. Categories that are
+// not counted as busy count as idle, except for steal: it is time the host
+// never gave to the instance, so when excluded it is left out of the total
+// and the usage is relative to the CPU time that was actually available.
+func (c CPUTime) usage(st cpu.TimesStat) float64 {
+	total := st.Idle + st.User + st.Nice + st.System + st.Iowait + st.Irq + st.Softirq + st.Steal
+	if c&CPUSteal == 0 {
+		total -= st.Steal
+	}
+	if total <= 0 {
+		return 0
+	}
+	return c.busy(st) * 100.0 / total
+}
+
+// busy returns the sum of the CPU times in st that belong to the set.
+func (c CPUTime) busy(st cpu.TimesStat) float64 {
+	var busy float64
+	for _, f := range []struct {
+		category CPUTime
+		time     float64
+	}{
+		{CPUUser, st.User},
+		{CPUNice, st.Nice},
+		{CPUSystem, st.System},
+		{CPUIowait, st.Iowait},
+		{CPUIrq, st.Irq},
+		{CPUSoftirq, st.Softirq},
+		{CPUSteal, st.Steal},
+	} {
+		if c&f.category != 0 {
+			busy += f.time
+		}
+	}
+	return busy
+}
@@ -0,0 +1,53 @@
+package throttler
+
+import "sync/atomic"
+
+// errorFeedback is the configuration of the error rate feedback.
+type errorFeedback struct {
+	L, K        float64
+	minRequests uint64
+}
+
+// EnableErrorFeedback makes the % of requests reported as failed with
+// ReportResult drive the throttler together with the CPU usage, using its
+// own limit and multiplier. Rising internal errors such as 5xx responses or
+// timeouts are often the first symptom of overload, so this pulls R down
+// even before the CPU usage crosses L.
+//
+// The error rate is computed once per T from every result reported during
+// the interval. Intervals with less than minRequests results are ignored so
+// a handful of errors on low traffic can not drive R to 0. It must be called
+// before Start.
+func (t *T) EnableErrorFeedback(limit, k float64, minRequests uint64) {
+	t.smu.Lock()
+	defer t.smu.Unlock()
+	t.errors = &errorFeedback{L: limit, K: k, minRequests: minRequests}
+}
+
+// ReportResult records the outcome of a request served by the instance.
+// failed should be true for internal errors and timeouts.
+func (t *T) ReportResult(failed bool) {
+	if failed {
+		atomic.AddUint64(&t.failed, 1)
+		return
+	}
+	atomic.AddUint64(&t.succeeded, 1)
+}
+
+// swapResults returns the results reported since the last
+// call and resets them.
+func (t *T) swapResults() (succeeded, failed uint64) {
+	return atomic.SwapUint64(&t.succeeded, 0), atomic.SwapUint64(&t.failed, 0)
+}
+
+// errorR computes the new R for the error rate of the interval given the
+// current R. The boolean is false if the error feedback is disabled or there
+// were not enough results. The caller must hold t.smu.
+func (t *T) errorR(r float64, succeeded, failed uint64) (float64, bool) {
+	total := succeeded + failed
+	if t.errors == nil || total == 0 || total < t.errors.minRequests {
+		return 0, false
+	}
+	rate := float64(failed) * 100 / float64(total)
+	return nextR(r, rate, t.errors.L, t.errors.K), true
+}
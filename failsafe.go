@@ -0,0 +1,135 @@
+package throttler
+
+import (
+	"log"
+	"math"
+	"sync/atomic"
+	"unsafe"
+)
+
+// Failsafe configures a simple threshold-based backup controller that
+// takes over when the primary controller appears to be broken. The
+// primary controller is considered broken when:
+//   - it computes an R that is NaN or Inf
+//   - no adjustments were made for MaxIdleIntervals consecutive intervals
+//   - MaxSignalErrors consecutive samples of the CPU usage or of any
+//     additional signal could not be collected
+//
+// While the failsafe is engaged, R is forced to Failsafe.R whenever the last
+// known CPU usage sample is unknown or above or equal to L, or an additional
+// signal is failing, and to 100 otherwise. The primary controller takes over
+// again as soon as it makes a valid adjustment while no signal is failing.
+type Failsafe struct {
+	// R is the % of allowed requests forced while shedding.
+	R float64
+	// MaxIdleIntervals is the amount of consecutive intervals without an
+	// adjustment after which the failsafe is engaged. Zero disables the check.
+	MaxIdleIntervals int
+	// MaxSignalErrors is the amount of consecutive sample errors after which
+	// the failsafe is engaged. Zero disables the check.
+	MaxSignalErrors int
+}
+
+// failsafeState is the state the control loop keeps to detect
+// when the primary controller is broken.
+type failsafeState struct {
+	engaged       bool
+	idleIntervals int
+	signalErrors  int
+	lastSample    float64
+	hasSample     bool
+}
+
+// failsafeSample records the result of collecting a sample.
+// The caller must hold t.smu.
+func (t *T) failsafeSample(x float64, err error) {
+	if t.Failsafe == nil {
+		return
+	}
+	if err != nil {
+		t.failsafe.signalErrors++
+		t.failsafe.hasSample = false
+		if t.Failsafe.MaxSignalErrors > 0 && t.failsafe.signalErrors >= t.Failsafe.MaxSignalErrors {
+			t.engageFailsafe("too many consecutive signal errors", false)
+		}
+		return
+	}
+	t.failsafe.signalErrors = 0
+	t.failsafe.lastSample = x
+	t.failsafe.hasSample = true
+}
+
+// failsafeIdle records that an interval ended without an adjustment.
+// The caller must hold t.smu.
+func (t *T) failsafeIdle() {
+	if t.Failsafe == nil {
+		return
+	}
+	t.failsafe.idleIntervals++
+	if t.Failsafe.MaxIdleIntervals > 0 && t.failsafe.idleIntervals >= t.Failsafe.MaxIdleIntervals {
+		t.engageFailsafe("too many intervals without adjustments", false)
+	}
+}
+
+// failsafeAdjust checks the R computed by the primary controller and
+// returns whether it should be applied. The caller must hold t.smu.
+func (t *T) failsafeAdjust(newR float64) bool {
+	if t.Failsafe == nil {
+		return true
+	}
+	if math.IsNaN(newR) || math.IsInf(newR, 0) {
+		t.engageFailsafe("primary controller computed an invalid R", false)
+		return false
+	}
+	for _, sig := range t.signals {
+		if t.signalFailing(sig) {
+			t.engageFailsafe("too many consecutive errors collecting "+sig.Name, true)
+			return false
+		}
+	}
+	t.failsafe.idleIntervals = 0
+	if t.failsafe.engaged {
+		log.Println("primary controller recovered, disengaging failsafe")
+		t.failsafe.engaged = false
+	}
+	return true
+}
+
+// failsafeSignalSample records the result of collecting a sample of an
+// additional signal. The caller must hold t.smu.
+func (t *T) failsafeSignalSample(s *signal, err error) {
+	if err == nil {
+		s.errors = 0
+		return
+	}
+	s.errors++
+	if t.signalFailing(s) {
+		t.engageFailsafe("too many consecutive errors collecting "+s.Name, true)
+	}
+}
+
+// signalFailing returns whether the additional signal s failed too many
+// consecutive times. The caller must hold t.smu.
+func (t *T) signalFailing(s *signal) bool {
+	return t.Failsafe != nil && t.Failsafe.MaxSignalErrors > 0 && s.errors >= t.Failsafe.MaxSignalErrors
+}
+
+// engageFailsafe engages the backup controller, if it is not already
+// engaged, and applies its R. If shed is true R is forced to Failsafe.R
+// regardless of the last CPU usage sample, which is used when the failing
+// signal is not the CPU usage. The caller must hold t.smu.
+func (t *T) engageFailsafe(reason string, shed bool) {
+	if !t.failsafe.engaged {
+		log.Printf("engaging failsafe: %s", reason)
+		t.failsafe.engaged = true
+	}
+
+	r := t.Failsafe.R
+	if !shed && t.failsafe.hasSample && t.failsafe.lastSample < t.L {
+		r = 100
+	}
+	old := *(*float64)(atomic.LoadPointer(&t.r))
+	atomic.StorePointer(&t.r, unsafe.Pointer(&r))
+	t.lastStep = r - old
+	t.notify(func(o Observer) { o.AdjustmentApplied(old, r) })
+}
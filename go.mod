@@ -5,4 +5,5 @@ go 1.16
 require (
 	github.com/matryer/is v1.4.0
 	github.com/shirou/gopsutil/v3 v3.21.2
+	golang.org/x/net v0.0.0-20210226172049-e18ecbb05110
 )
@@ -0,0 +1,61 @@
+package throttler
+
+import (
+	"context"
+	"crypto/tls"
+	"net/http"
+	"sync/atomic"
+
+	"golang.org/x/net/http2"
+)
+
+// MaxConcurrentStreams returns the HTTP/2 MAX_CONCURRENT_STREAMS that
+// should be advertised to clients given the current R. It scales max by
+// R and never returns less than 1 so clients can always make progress.
+func (t *T) MaxConcurrentStreams(max uint32) uint32 {
+	r := *(*float64)(atomic.LoadPointer(&t.r))
+	n := uint32(float64(max) * r / 100)
+	if n < 1 {
+		n = 1
+	}
+	return n
+}
+
+// ConfigureHTTP2Server configures srv to serve HTTP/2 over TLS using conf,
+// just like http2.ConfigureServer, but advertising a MAX_CONCURRENT_STREAMS
+// computed with t.MaxConcurrentStreams(max). This pushes backpressure to
+// clients at the protocol level before requests are even sent.
+//
+// The limit is advertised when a connection is established, so changes in R
+// only apply to new connections. conf.MaxConcurrentStreams is ignored.
+func (t *T) ConfigureHTTP2Server(srv *http.Server, conf *http2.Server, max uint32) error {
+	if conf == nil {
+		conf = new(http2.Server)
+	}
+	if err := http2.ConfigureServer(srv, conf); err != nil {
+		return err
+	}
+
+	srv.TLSNextProto[http2.NextProtoTLS] = func(hs *http.Server, c *tls.Conn, h http.Handler) {
+		// net/http passes down its per-connection base context
+		// through the handler, see http2.ConfigureServer
+		var ctx context.Context
+		type baseContexter interface {
+			BaseContext() context.Context
+		}
+		if bc, ok := h.(baseContexter); ok {
+			ctx = bc.BaseContext()
+		}
+
+		// the copy shares the internal state of conf so graceful
+		// shutdowns keep working for every connection
+		connConf := *conf
+		connConf.MaxConcurrentStreams = t.MaxConcurrentStreams(max)
+		connConf.ServeConn(c, &http2.ServeConnOpts{
+			Context:    ctx,
+			Handler:    h,
+			BaseConfig: hs,
+		})
+	}
+	return nil
+}
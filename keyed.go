@@ -0,0 +1,158 @@
+package throttler
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// KeyStats is the admission state of a single key tracked by Keyed.
+type KeyStats struct {
+	// Admitted is the amount of requests that were allowed.
+	Admitted uint64
+	// Throttled is the amount of requests that were throttled.
+	Throttled uint64
+	// LastSeen is the last time a request was made for the key.
+	LastSeen time.Time
+}
+
+// entry is the element stored in the LRU list of Keyed.
+type entry struct {
+	key string
+	KeyStats
+
+	// weight is the share of the key when waiting, finish the
+	// virtual finish time of its last queued request and waiting
+	// the amount of requests of the key that are queued
+	weight  float64
+	finish  float64
+	waiting int
+}
+
+// Keyed tracks the admission state of many keys (typically users or
+// tenants) that share the same T. Keys that were not seen for the
+// configured TTL are evicted and, if the amount of keys goes over the
+// configured maximum, the least recently used ones are evicted first
+// so memory does not grow without bound.
+//
+// Keyed is safe for concurrent use.
+type Keyed struct {
+	t          *T
+	ttl        time.Duration
+	maxEntries int
+	now        func() time.Time
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List
+
+	// wait queue, see Wait
+	queue waitQueue
+	vtime float64
+}
+
+// NewKeyed creates a new Keyed on top of t. A ttl or maxEntries of zero
+// disables the corresponding eviction. t keeps a reference to the Keyed so
+// its control loop can drain the requests queued in Wait.
+func NewKeyed(t *T, ttl time.Duration, maxEntries int) *Keyed {
+	k := &Keyed{
+		t:          t,
+		ttl:        ttl,
+		maxEntries: maxEntries,
+		now:        time.Now,
+		entries:    map[string]*list.Element{},
+		lru:        list.New(),
+	}
+	t.addWaitQueue(k)
+	return k
+}
+
+// Allow returns whether the request for key is allowed to go through or if
+// it is throttled, recording the decision in the state of the key.
+func (k *Keyed) Allow(key string) bool {
+	allowed := k.t.Allow()
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	e := k.touch(key)
+	if allowed {
+		e.Admitted++
+	} else {
+		e.Throttled++
+	}
+	return allowed
+}
+
+// Stats returns the admission state of key and whether it is being tracked.
+func (k *Keyed) Stats(key string) (KeyStats, bool) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	el, ok := k.entries[key]
+	if !ok {
+		return KeyStats{}, false
+	}
+	return el.Value.(*entry).KeyStats, true
+}
+
+// Len returns the amount of keys being tracked.
+func (k *Keyed) Len() int {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return k.lru.Len()
+}
+
+// Evict removes the keys that were not seen for longer than the TTL and
+// returns how many were removed. Keys are also evicted as new requests come
+// in, Evict is meant to be called periodically to free memory when traffic
+// stops.
+func (k *Keyed) Evict() int {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return k.evict(nil)
+}
+
+// touch returns the entry for key, creating it if necessary, and marks
+// it as the most recently used. The caller must hold k.mu.
+func (k *Keyed) touch(key string) *entry {
+	now := k.now()
+	el, ok := k.entries[key]
+	if ok {
+		k.lru.MoveToFront(el)
+	} else {
+		el = k.lru.PushFront(&entry{key: key, weight: 1})
+		k.entries[key] = el
+	}
+	e := el.Value.(*entry)
+	e.LastSeen = now
+	k.evict(el)
+	return e
+}
+
+// evict removes expired entries and, if there are still more than
+// maxEntries, the least recently used ones. Entries with requests queued
+// in Wait are never evicted so their place in the fair schedule is kept,
+// and neither is keep, which can be nil. The caller must hold k.mu.
+func (k *Keyed) evict(keep *list.Element) int {
+	var (
+		evicted int
+		now     = k.now()
+	)
+	for el := k.lru.Back(); el != nil; {
+		prev := el.Prev()
+		e := el.Value.(*entry)
+		if e.waiting > 0 || el == keep {
+			el = prev
+			continue
+		}
+		expired := k.ttl > 0 && now.Sub(e.LastSeen) > k.ttl
+		full := k.maxEntries > 0 && k.lru.Len() > k.maxEntries
+		if !expired && !full {
+			break
+		}
+		k.lru.Remove(el)
+		delete(k.entries, e.key)
+		evicted++
+		el = prev
+	}
+	return evicted
+}
@@ -0,0 +1,58 @@
+package throttler
+
+// Observer receives the events that happen within the control loop of T.
+// It allows users to build custom telemetry or adaptive logic on top of
+// the throttler without having to fork the control loop.
+//
+// All methods are called synchronously from the goroutine running
+// t.Start, so implementations should return quickly. They are called
+// without holding any lock of T, so they can call back into it.
+type Observer interface {
+	// SampleCollected is called every ST with the CPU usage sample (X)
+	// that was collected.
+	SampleCollected(x float64)
+	// IntervalComputed is called at the end of every T with the average
+	// CPU usage of the interval and the amount of samples it was computed from.
+	IntervalComputed(avg float64, samples int)
+	// AdjustmentApplied is called after R was updated at the end of an interval.
+	AdjustmentApplied(oldR, newR float64)
+	// SignalError is called when a sample could not be collected.
+	SignalError(err error)
+}
+
+// nopObserver is the Observer used when the user did not set one.
+type nopObserver struct{}
+
+func (nopObserver) SampleCollected(float64)            {}
+func (nopObserver) IntervalComputed(float64, int)      {}
+func (nopObserver) AdjustmentApplied(float64, float64) {}
+func (nopObserver) SignalError(error)                  {}
+
+func (t *T) observer() Observer {
+	if t.Observer == nil {
+		return nopObserver{}
+	}
+	return t.Observer
+}
+
+// notify queues an event for the Observer. Events are queued while holding
+// t.smu and delivered by unlockState once it is released, so observers can
+// call back into T. The caller must hold t.smu.
+func (t *T) notify(event func(Observer)) {
+	if t.Observer == nil {
+		return
+	}
+	t.events = append(t.events, event)
+}
+
+// unlockState releases t.smu and delivers the queued events.
+func (t *T) unlockState() {
+	events := t.events
+	t.events = nil
+	t.smu.Unlock()
+
+	o := t.observer()
+	for _, event := range events {
+		event(o)
+	}
+}
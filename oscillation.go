@@ -0,0 +1,135 @@
+package throttler
+
+import (
+	"log"
+	"math"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// maxDamping is the maximum amount of times K is halved while damping.
+	maxDamping = 4
+	// defaultOscillationIntervals is used when Oscillation.Intervals is not positive.
+	defaultOscillationIntervals = 2
+)
+
+// Oscillation configures the detection of R oscillating with a large
+// amplitude across consecutive intervals, which is usually a sign of a
+// mis-tuned K or T.
+type Oscillation struct {
+	// Amplitude is the minimum change of R within an interval for it to
+	// be considered part of an oscillation.
+	Amplitude float64
+	// Intervals is the amount of consecutive intervals in which R has to
+	// change direction for T to be considered oscillating. It defaults to 2.
+	Intervals int
+	// AutoDamp halves K every interval while T is oscillating, up to
+	// 16 times smaller, and restores it once the oscillation subsides.
+	// Oscillations are measured against the step the undamped K would
+	// have produced, so damping is kept until the load itself settles.
+	AutoDamp bool
+}
+
+// oscillationState is the state the control loop keeps
+// to detect oscillations.
+type oscillationState struct {
+	reversals   int
+	oscillating bool
+	damping     int
+	// last is the undamped step of the previous interval
+	last float64
+}
+
+// Health is a summary of the state of the controller of T.
+type Health struct {
+	// R is the % of allowed requests.
+	R float64
+	// K is the multiplier currently in use, which differs
+	// from T.K while damping an oscillation.
+	K float64
+	// FailsafeEngaged is whether the backup controller took over.
+	FailsafeEngaged bool
+	// Oscillating is whether R is oscillating across intervals.
+	Oscillating bool
+	// Interval is the current T.
+	Interval time.Duration
+	// IntervalStep is the current ST.
+	IntervalStep time.Duration
+	// Shadow is whether a shadow controller is attached and
+	// ShadowR the R it would be using.
+	Shadow  bool
+	ShadowR float64
+}
+
+// Health returns a summary of the state of the controller.
+func (t *T) Health() Health {
+	t.smu.Lock()
+	defer t.smu.Unlock()
+	var shadowR float64
+	if t.shadow != nil {
+		shadowR = t.shadow.r
+	}
+	return Health{
+		R:               *(*float64)(atomic.LoadPointer(&t.r)),
+		K:               t.k(),
+		FailsafeEngaged: t.failsafe.engaged,
+		Oscillating:     t.oscillation.oscillating,
+		Interval:        t.interval,
+		IntervalStep:    t.intervalStep,
+		Shadow:          t.shadow != nil,
+		ShadowR:         shadowR,
+	}
+}
+
+// k returns the multiplier to use for the step, taking damping into
+// account. The caller must hold t.smu.
+func (t *T) k() float64 {
+	return math.Ldexp(t.K, -t.oscillation.damping)
+}
+
+// detectOscillation records the change applied to R at the end of an
+// interval and updates the oscillation state. The caller must hold t.smu.
+func (t *T) detectOscillation(step float64) {
+	if t.Oscillation == nil {
+		return
+	}
+
+	// compare the step the undamped K would have produced, otherwise
+	// the damped steps would hide the oscillation right away
+	var (
+		a    = t.Oscillation.Amplitude
+		curr = math.Ldexp(step, t.oscillation.damping)
+		last = t.oscillation.last
+	)
+	if math.Abs(curr) >= a && math.Abs(last) >= a && curr*last < 0 {
+		t.oscillation.reversals++
+	} else {
+		t.oscillation.reversals = 0
+	}
+	t.oscillation.last = curr
+
+	intervals := t.Oscillation.Intervals
+	if intervals < 1 {
+		intervals = defaultOscillationIntervals
+	}
+	oscillating := t.oscillation.reversals >= intervals
+	if oscillating != t.oscillation.oscillating {
+		if oscillating {
+			log.Printf("R is oscillating with an amplitude of at least %.2f", a)
+		} else {
+			log.Println("R stopped oscillating")
+		}
+		t.oscillation.oscillating = oscillating
+	}
+
+	if !t.Oscillation.AutoDamp {
+		return
+	}
+	switch {
+	case oscillating && t.oscillation.damping < maxDamping:
+		t.oscillation.damping++
+	case !oscillating && t.oscillation.damping > 0:
+		t.oscillation.damping--
+	}
+}
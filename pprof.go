@@ -0,0 +1,58 @@
+package throttler
+
+import (
+	"context"
+	"net/http"
+	"runtime/pprof"
+	"strconv"
+)
+
+// pprof label keys attached to the goroutines handling requests so CPU
+// profiles can attribute the cost to admitted or throttled traffic.
+const (
+	LabelThrottled = "throttled"
+	LabelPriority  = "priority"
+)
+
+// Labels returns the pprof labels for a request with the given throttling
+// decision and priority class. The priority label is omitted if empty.
+func Labels(throttled bool, priority string) pprof.LabelSet {
+	if priority == "" {
+		return pprof.Labels(LabelThrottled, strconv.FormatBool(throttled))
+	}
+	return pprof.Labels(LabelThrottled, strconv.FormatBool(throttled), LabelPriority, priority)
+}
+
+// AllowLabeled is like Allow but it calls f with the decision while the pprof
+// labels of the decision and priority class are attached to the calling
+// goroutine. The labels are removed when f returns, so goroutines reused
+// across requests such as keep-alive connections or worker pools are not
+// left with stale labels. The context passed to f carries the labels so
+// goroutines started from it can be labeled too.
+func (t *T) AllowLabeled(ctx context.Context, priority string, f func(ctx context.Context, allowed bool)) {
+	allowed := t.Allow()
+	pprof.Do(ctx, Labels(!allowed, priority), func(ctx context.Context) {
+		f(ctx, allowed)
+	})
+}
+
+// Middleware returns a handler that throttles the requests to next, responding
+// with 503 Service Unavailable to the ones that are not allowed. Both admitted
+// and throttled requests are handled with pprof labels attached, see Labels.
+// priority returns the priority class of a request and can be nil.
+func (t *T) Middleware(next http.Handler, priority func(*http.Request) string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var class string
+		if priority != nil {
+			class = priority(r)
+		}
+
+		t.AllowLabeled(r.Context(), class, func(ctx context.Context, allowed bool) {
+			if !allowed {
+				http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+				return
+			}
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	})
+}
@@ -0,0 +1,49 @@
+package throttler
+
+// shadow is a controller configuration that runs against the same
+// samples as T but whose R is never used to throttle requests.
+type shadow struct {
+	L, K float64
+	r    float64
+}
+
+// SetShadow attaches a shadow controller with limit l and multiplier k.
+// At the end of every interval the shadow controller computes what its R
+// would have been using the same average CPU usage as T, regardless of what
+// T ends up doing with its own R, and exposes it through ShadowR, Health and
+// Snapshot. This allows evaluating new tunings in production without
+// affecting which requests are allowed. The shadow controller starts
+// allowing all requests. Calling SetShadow again replaces the previous
+// shadow controller.
+func (t *T) SetShadow(l, k float64) {
+	t.smu.Lock()
+	defer t.smu.Unlock()
+	t.shadow = &shadow{L: l, K: k, r: 100}
+}
+
+// RemoveShadow detaches the shadow controller, if any.
+func (t *T) RemoveShadow() {
+	t.smu.Lock()
+	defer t.smu.Unlock()
+	t.shadow = nil
+}
+
+// ShadowR returns the R the shadow controller would be using. The boolean
+// is false if no shadow controller is attached.
+func (t *T) ShadowR() (float64, bool) {
+	t.smu.Lock()
+	defer t.smu.Unlock()
+	if t.shadow == nil {
+		return 0, false
+	}
+	return t.shadow.r, true
+}
+
+// adjustShadow updates the R of the shadow controller, if any, with the
+// average CPU usage of the interval. The caller must hold t.smu.
+func (t *T) adjustShadow(avg float64) {
+	if t.shadow == nil {
+		return
+	}
+	t.shadow.r = nextR(t.shadow.r, avg, t.shadow.L, t.shadow.K)
+}
@@ -0,0 +1,64 @@
+package throttler
+
+import (
+	"fmt"
+	"log"
+)
+
+// Signal is an additional input that drives the throttler together with
+// the CPU usage. Every signal has its own limit and multiplier so, for
+// example, CPU usage can target 75 with K=2 while memory usage targets 90
+// with K=4. At the end of every interval R is computed for the CPU usage
+// and for every signal and the most restrictive one is applied.
+type Signal struct {
+	// Name identifies the signal in logs, errors and snapshots.
+	Name string
+	// L is the limit for the signal.
+	L float64
+	// K is the multiplier for the step difference of the signal.
+	K float64
+	// Sample collects a sample of the signal. It is called every ST.
+	Sample func() (float64, error)
+}
+
+// signal is a Signal together with the samples collected
+// during the current interval.
+type signal struct {
+	Signal
+	stats []float64
+	// errors is the amount of consecutive samples that failed
+	errors int
+}
+
+// AddSignal adds a signal that drives the throttler together with the
+// CPU usage. It must be called before Start.
+func (t *T) AddSignal(s Signal) {
+	t.smu.Lock()
+	defer t.smu.Unlock()
+	t.signals = append(t.signals, &signal{Signal: s, stats: []float64{}})
+}
+
+// sampleSignals collects a sample of every signal and adds it to its stats.
+func (t *T) sampleSignals() {
+	for _, s := range t.signals {
+		x, err := s.Sample()
+		t.smu.Lock()
+		t.failsafeSignalSample(s, err)
+		if err != nil {
+			t.unlockState()
+			log.Printf("could not collect %s stats: %s", s.Name, err)
+			t.observer().SignalError(fmt.Errorf("signal %s: %w", s.Name, err))
+			continue
+		}
+		s.stats = append(s.stats, x)
+		t.unlockState()
+	}
+}
+
+// resetSignals resets the stats of every signal for the next interval.
+// The caller must hold t.smu.
+func (t *T) resetSignals() {
+	for _, s := range t.signals {
+		s.stats = []float64{}
+	}
+}
@@ -0,0 +1,144 @@
+package throttler
+
+import (
+	"math"
+	"sync/atomic"
+	"time"
+	"unsafe"
+)
+
+// Snapshot is the full state of the controller of a T at a given moment.
+// It can be used to hand off the state from one instance to another or to
+// persist it across restarts.
+type Snapshot struct {
+	// R is the % of allowed requests.
+	R float64
+	// Samples are the CPU usage samples accumulated during the
+	// current interval.
+	Samples []float64
+	// SignalSamples are the samples of every additional signal
+	// accumulated during the current interval, keyed by signal name.
+	SignalSamples map[string][]float64
+	// LastStep is the change that was applied to R at the end
+	// of the last interval.
+	LastStep float64
+	// FailsafeEngaged is whether the backup controller had taken over.
+	FailsafeEngaged bool
+	// FailsafeIdleIntervals is the amount of consecutive intervals
+	// without an adjustment.
+	FailsafeIdleIntervals int
+	// FailsafeSignalErrors is the amount of consecutive CPU usage
+	// samples that could not be collected.
+	FailsafeSignalErrors int
+	// HasLastSample is whether the last CPU usage sample was collected
+	// and LastSample its value.
+	HasLastSample bool
+	LastSample    float64
+	// SignalErrors is the amount of consecutive samples of every
+	// additional signal that could not be collected, keyed by signal name.
+	SignalErrors map[string]int
+	// Capacity is the estimated sustainable requests per second.
+	Capacity float64
+	// Damping is the amount of times K was halved to damp an oscillation.
+	Damping int
+	// Oscillating is whether R was oscillating and OscillationReversals
+	// the amount of consecutive intervals in which it changed direction.
+	Oscillating          bool
+	OscillationReversals int
+	// Interval is T, which can be changed by the auto-tuning.
+	Interval time.Duration
+	// IntervalStep is ST, which can be changed by the auto-tuning.
+	IntervalStep time.Duration
+	// Shadow is whether a shadow controller was attached and
+	// ShadowR the R it was using.
+	Shadow  bool
+	ShadowR float64
+}
+
+// Snapshot returns the current state of the controller.
+func (t *T) Snapshot() Snapshot {
+	t.smu.Lock()
+	defer t.smu.Unlock()
+
+	samples := make([]float64, len(t.stats))
+	copy(samples, t.stats)
+	var (
+		signalSamples map[string][]float64
+		signalErrors  map[string]int
+	)
+	if len(t.signals) > 0 {
+		signalSamples = make(map[string][]float64, len(t.signals))
+		signalErrors = make(map[string]int, len(t.signals))
+		for _, s := range t.signals {
+			signalSamples[s.Name] = append([]float64{}, s.stats...)
+			signalErrors[s.Name] = s.errors
+		}
+	}
+	var shadowR float64
+	if t.shadow != nil {
+		shadowR = t.shadow.r
+	}
+	return Snapshot{
+		R:                     *(*float64)(atomic.LoadPointer(&t.r)),
+		Samples:               samples,
+		SignalSamples:         signalSamples,
+		LastStep:              t.lastStep,
+		FailsafeEngaged:       t.failsafe.engaged,
+		FailsafeIdleIntervals: t.failsafe.idleIntervals,
+		FailsafeSignalErrors:  t.failsafe.signalErrors,
+		HasLastSample:         t.failsafe.hasSample,
+		LastSample:            t.failsafe.lastSample,
+		SignalErrors:          signalErrors,
+		Capacity:              t.capacity,
+		Damping:               t.oscillation.damping,
+		Oscillating:           t.oscillation.oscillating,
+		OscillationReversals:  t.oscillation.reversals,
+		Interval:              t.interval,
+		IntervalStep:          t.intervalStep,
+		Shadow:                t.shadow != nil,
+		ShadowR:               shadowR,
+	}
+}
+
+// Restore replaces the state of the controller with s. It can be called
+// while the throttler is running. If it is called before Start, the control
+// loop starts from the restored state instead of allowing all requests.
+// The intervals are only restored if both are positive and, while running,
+// they take effect at the end of the current interval.
+func (t *T) Restore(s Snapshot) {
+	t.smu.Lock()
+	defer t.smu.Unlock()
+
+	r := s.R
+	atomic.StorePointer(&t.r, unsafe.Pointer(&r))
+	t.resetCounters()
+	t.stats = make([]float64, len(s.Samples))
+	copy(t.stats, s.Samples)
+	for _, sig := range t.signals {
+		sig.stats = append([]float64{}, s.SignalSamples[sig.Name]...)
+		sig.errors = s.SignalErrors[sig.Name]
+	}
+	t.lastStep = s.LastStep
+	t.failsafe = failsafeState{
+		engaged:       s.FailsafeEngaged,
+		idleIntervals: s.FailsafeIdleIntervals,
+		signalErrors:  s.FailsafeSignalErrors,
+		lastSample:    s.LastSample,
+		hasSample:     s.HasLastSample,
+	}
+	t.capacity = s.Capacity
+	t.oscillation.damping = s.Damping
+	t.oscillation.oscillating = s.Oscillating
+	t.oscillation.reversals = s.OscillationReversals
+	t.oscillation.last = math.Ldexp(s.LastStep, s.Damping)
+	if s.Shadow && t.shadow != nil {
+		t.shadow.r = s.ShadowR
+	}
+	if s.Interval > 0 && s.IntervalStep > 0 {
+		t.interval, t.intervalStep = s.Interval, s.IntervalStep
+	}
+
+	t.mu.Lock()
+	t.restored = !t.started
+	t.mu.Unlock()
+}
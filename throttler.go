@@ -4,6 +4,7 @@ package throttler
 import (
 	"errors"
 	"log"
+	"math"
 	"math/rand"
 	"sync"
 	"sync/atomic"
@@ -37,18 +38,69 @@ var ErrAlreadyStarted = errors.New("throttler has already been started")
 //
 // T is safe for concurrent use.
 type T struct {
+	// admitted is the amount of requests allowed during the current
+	// interval, succeeded and failed are the amount of results reported
+	// since the last sample. They are accessed atomically and kept first
+	// in the struct to guarantee their 64-bit alignment.
+	admitted  uint64
+	succeeded uint64
+	failed    uint64
+
 	L float64
 	R float64
 	K float64
 
+	// Observer, if set, is notified of the events that happen within the
+	// control loop. It must be set before calling Start.
+	Observer Observer
+
+	// Failsafe, if set, configures the backup controller that takes over
+	// when the primary controller appears to be broken. It must be set
+	// before calling Start.
+	Failsafe *Failsafe
+
+	// YieldR is the R at or below which CheckIn starts asking long-lived
+	// requests to yield. Zero disables it. It must be set before calling Start.
+	YieldR float64
+
+	// Oscillation, if set, configures the detection of R oscillating
+	// across intervals. It must be set before calling Start.
+	Oscillation *Oscillation
+
+	// AutoTune, if set, configures the automatic tuning of T and ST based
+	// on the variance of the samples. It must be set before calling Start.
+	AutoTune *AutoTune
+
+	// BusyCPUTimes is the set of CPU time categories counted as busy when
+	// computing the CPU usage. It defaults to DefaultBusyCPUTimes and must
+	// be set before calling Start.
+	BusyCPUTimes CPUTime
+
 	r unsafe.Pointer
 
 	cpuUsage               func() (float64, error)
 	rand                   *rand.Rand
+	randMu                 sync.Mutex
 	interval, intervalStep time.Duration
 	done                   chan struct{}
 	mu                     sync.Mutex
 	started                bool
+	restored               bool
+
+	// smu protects the controller state that is accumulated
+	// by the control loop, as well as interval and intervalStep
+	// since they can be tuned by it
+	smu         sync.Mutex
+	stats       []float64
+	lastStep    float64
+	shadow      *shadow
+	failsafe    failsafeState
+	signals     []*signal
+	capacity    float64
+	oscillation oscillationState
+	errors      *errorFeedback
+	events      []func(Observer)
+	queues      []*Keyed
 }
 
 // New creates a new throttler with the specified parameters.
@@ -59,27 +111,39 @@ func New(cpuLimit, k float64, interval, intervalStep time.Duration) *T {
 		interval:     interval,
 		intervalStep: intervalStep,
 		rand:         rand.New(rand.NewSource(time.Now().UnixNano())),
-		cpuUsage:     getCpuUsage,
+		BusyCPUTimes: DefaultBusyCPUTimes,
+		done:         make(chan struct{}),
 	}
+	t.cpuUsage = t.getCpuUsage
 	var r float64 = 100.0
 	atomic.StorePointer(&t.r, unsafe.Pointer(&r))
 	return t
 }
 
-func getCpuUsage() (float64, error) {
+func (t *T) getCpuUsage() (float64, error) {
 	cpuStats, err := cpu.Times(false)
 	if err != nil || len(cpuStats) != 1 {
 		return 0, err
 	}
 
-	st := cpuStats[0]
-	total := st.Idle + st.Guest + st.GuestNice + st.Iowait + st.Irq + st.Nice + st.Softirq + st.Steal + st.System + st.User
-	return 100 - (st.Idle*100.0)/total, nil
+	return t.BusyCPUTimes.usage(cpuStats[0]), nil
 }
 
 // Allow returns whether the request is allowed to go through or if it is throttled.
 func (t *T) Allow() bool {
-	return (t.rand.Float64() * 100.0) < *(*float64)(atomic.LoadPointer(&t.r))
+	allowed := (t.float64() * 100.0) < *(*float64)(atomic.LoadPointer(&t.r))
+	if allowed {
+		atomic.AddUint64(&t.admitted, 1)
+	}
+	return allowed
+}
+
+// float64 returns a pseudo-random number in [0.0,1.0). t.rand is not safe
+// for concurrent use, so it is protected by t.randMu.
+func (t *T) float64() float64 {
+	t.randMu.Lock()
+	defer t.randMu.Unlock()
+	return t.rand.Float64()
 }
 
 // Start starts the control loop that collects CPU information every ST and computes
@@ -94,15 +158,27 @@ func (t *T) Start() error {
 	t.started = true
 	t.mu.Unlock()
 
-	// we start by allowing all requests to go through
-	var r float64 = 100.0
-	atomic.StorePointer(&t.r, unsafe.Pointer(&r))
+	// we start by allowing all requests to go through, unless
+	// the state of the controller was restored from a snapshot
+	t.smu.Lock()
+	if !t.restored {
+		var r float64 = 100.0
+		atomic.StorePointer(&t.r, unsafe.Pointer(&r))
+		t.stats = []float64{}
+		t.resetSignals()
+		t.resetCounters()
+	}
+	t.restored = false
+	t.smu.Unlock()
 
+	t.smu.Lock()
 	var (
-		itk   = time.NewTicker(t.interval)
-		istk  = time.NewTicker(t.intervalStep)
-		stats = []float64{}
+		currInterval     = t.interval
+		currIntervalStep = t.intervalStep
+		itk              = time.NewTicker(currInterval)
+		istk             = time.NewTicker(currIntervalStep)
 	)
+	t.smu.Unlock()
 	defer func() {
 		t.mu.Lock()
 		t.started = false
@@ -118,50 +194,117 @@ func (t *T) Start() error {
 			// end of the current interval, now we need to collect
 			// the stats, compute the average and make the adjustment if
 			// necessary
-			if len(stats) == 0 {
-				log.Println("could not collect any stats during the interval")
-				continue
-			}
+			t.smu.Lock()
+			t.adjust(t.stats)
+
+			// reset the stats for the next interval
+			t.stats = []float64{}
+			t.resetSignals()
+			interval, intervalStep := t.interval, t.intervalStep
+			t.unlockState()
 
-			var sum, avg float64
-			for _, stat := range stats {
-				sum += stat
+			// the intervals might have been tuned by the adjustment
+			if interval != currInterval {
+				itk.Reset(interval)
+				currInterval = interval
 			}
-			avg = sum / float64(len(stats))
-
-			r := *(*float64)(atomic.LoadPointer(&t.r))
-			step := t.K * (t.L - avg)
-			newR := r + step
-			switch {
-			case avg >= t.L:
-				// if the average CPU usage was above or equal to the
-				// limit we allow less requests to go in
-				if newR < 0 {
-					newR = 0
-				}
-				atomic.StorePointer(&t.r, unsafe.Pointer(&newR))
-			case avg < t.L:
-				// if the average CPU usage was below the limit
-				// then we can allow more requests to go in
-				if newR > 100 {
-					newR = 100
-				}
-				atomic.StorePointer(&t.r, unsafe.Pointer(&newR))
+			if intervalStep != currIntervalStep {
+				istk.Reset(intervalStep)
+				currIntervalStep = intervalStep
 			}
-
-			// reset the stats for the next interval
-			stats = []float64{}
 		case <-istk.C:
-			// step within the current interval, get a CPU usage sample and add
-			// to the stats
+			// step within the current interval, get a sample of every
+			// additional signal and a CPU usage sample and add them
+			// to the stats, also giving the requests queued in
+			// Keyed.Wait another chance
+			t.sampleSignals()
+			t.drainWaitQueues()
 			cpuUsage, err := t.cpuUsage()
+			t.smu.Lock()
+			t.failsafeSample(cpuUsage, err)
 			if err != nil {
+				t.unlockState()
 				log.Printf("could not collect CPU stats: %s", err)
+				t.observer().SignalError(err)
 				continue
 			}
-			stats = append(stats, cpuUsage)
+			t.stats = append(t.stats, cpuUsage)
+			t.unlockState()
+			t.observer().SampleCollected(cpuUsage)
+		}
+	}
+}
+
+// adjust computes the average of the samples collected during the interval
+// and updates R accordingly. The caller must hold t.smu.
+func (t *T) adjust(stats []float64) {
+	admitted := atomic.SwapUint64(&t.admitted, 0)
+	succeeded, failed := t.swapResults()
+	if len(stats) == 0 {
+		log.Println("could not collect any stats during the interval")
+		t.failsafeIdle()
+		return
+	}
+
+	avg := mean(stats)
+	t.notify(func(o Observer) { o.IntervalComputed(avg, len(stats)) })
+	t.estimateCapacity(admitted, avg)
+	t.autoTune(stats, avg)
+	t.adjustShadow(avg)
+
+	r := *(*float64)(atomic.LoadPointer(&t.r))
+	newR := nextR(r, avg, t.L, t.k())
+	// when multiple signals drive the throttler the final
+	// R is taken from the most restrictive one
+	for _, s := range t.signals {
+		if len(s.stats) == 0 {
+			continue
+		}
+		if sr := nextR(r, mean(s.stats), s.L, s.K); sr < newR || math.IsNaN(sr) {
+			newR = sr
+		}
+	}
+	if sr, ok := t.errorR(r, succeeded, failed); ok && sr < newR {
+		newR = sr
+	}
+	if !t.failsafeAdjust(newR) {
+		return
+	}
+	atomic.StorePointer(&t.r, unsafe.Pointer(&newR))
+	t.detectOscillation(newR - r)
+	t.lastStep = newR - r
+	t.notify(func(o Observer) { o.AdjustmentApplied(r, newR) })
+}
+
+// mean returns the average of the stats.
+func mean(stats []float64) float64 {
+	var sum float64
+	for _, stat := range stats {
+		sum += stat
+	}
+	return sum / float64(len(stats))
+}
+
+// nextR computes the new R for a controller with limit l and multiplier k
+// given the current R and the average CPU usage of the interval.
+func nextR(r, avg, l, k float64) float64 {
+	step := k * (l - avg)
+	newR := r + step
+	switch {
+	case avg >= l:
+		// if the average CPU usage was above or equal to the
+		// limit we allow less requests to go in
+		if newR < 0 {
+			newR = 0
+		}
+	case avg < l:
+		// if the average CPU usage was below the limit
+		// then we can allow more requests to go in
+		if newR > 100 {
+			newR = 100
 		}
 	}
+	return newR
 }
 
 // Stop stops the throttler. A user needs to call Start again to resume operations.
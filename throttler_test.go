@@ -1,11 +1,25 @@
 package throttler
 
 import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"runtime/pprof"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/matryer/is"
+	"github.com/shirou/gopsutil/v3/cpu"
+	"golang.org/x/net/http2"
 )
 
 func TestT_StartNoThrottle(t *testing.T) {
@@ -41,3 +55,895 @@ func TestT_LinearThrottle(t *testing.T) {
 	time.Sleep(2 * time.Millisecond)
 	is.True(!th.Allow())
 }
+
+type recorder struct {
+	samples     int
+	intervals   int
+	adjustments int
+	errors      int
+	lastR       float64
+}
+
+func (r *recorder) SampleCollected(float64)       { r.samples++ }
+func (r *recorder) IntervalComputed(float64, int) { r.intervals++ }
+func (r *recorder) AdjustmentApplied(_, newR float64) {
+	r.adjustments++
+	r.lastR = newR
+}
+func (r *recorder) SignalError(error) { r.errors++ }
+
+func TestT_Observer(t *testing.T) {
+	is := is.New(t)
+
+	rec := &recorder{}
+	th := New(10, 2, 2*time.Millisecond, 250*time.Microsecond)
+	th.Observer = rec
+
+	// events are delivered once the state is unlocked
+	th.smu.Lock()
+	th.adjust([]float64{20, 20})
+	is.Equal(rec.intervals, 0)
+	th.unlockState()
+	is.Equal(rec.intervals, 1)
+	is.Equal(rec.adjustments, 1)
+	is.Equal(rec.lastR, 80.0)
+
+	// no samples means no adjustment
+	th.smu.Lock()
+	th.adjust(nil)
+	th.unlockState()
+	is.Equal(rec.intervals, 1)
+	is.Equal(rec.adjustments, 1)
+}
+
+// reentrant is an Observer that calls back into the throttler.
+type reentrant struct {
+	th          *T
+	adjustments int32
+}
+
+func (r *reentrant) SampleCollected(float64)       { r.th.Capacity() }
+func (r *reentrant) IntervalComputed(float64, int) { r.th.Health() }
+func (r *reentrant) AdjustmentApplied(float64, float64) {
+	r.th.Snapshot()
+	atomic.AddInt32(&r.adjustments, 1)
+}
+func (r *reentrant) SignalError(error) { r.th.ShadowR() }
+
+func TestT_ObserverReentrant(t *testing.T) {
+	is := is.New(t)
+
+	th := New(10, 2, 2*time.Millisecond, 250*time.Microsecond)
+	obs := &reentrant{th: th}
+	th.Observer = obs
+	th.Failsafe = &Failsafe{R: 25, MaxSignalErrors: 1}
+	var i int
+	th.cpuUsage = func() (float64, error) {
+		i++
+		if i%3 == 0 {
+			return 0, errors.New("boom")
+		}
+		return 20, nil
+	}
+
+	go th.Start()
+	time.Sleep(20 * time.Millisecond)
+
+	done := make(chan struct{})
+	go func() {
+		th.Stop()
+		th.Snapshot()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("control loop deadlocked")
+	}
+	is.True(atomic.LoadInt32(&obs.adjustments) > 0)
+}
+
+func TestT_SnapshotRestore(t *testing.T) {
+	is := is.New(t)
+
+	th := New(10, 2, 2*time.Millisecond, 250*time.Microsecond)
+	th.smu.Lock()
+	th.adjust([]float64{20, 20})
+	th.stats = []float64{30, 40}
+	th.smu.Unlock()
+
+	s := th.Snapshot()
+	is.Equal(s.R, 80.0)
+	is.Equal(s.Samples, []float64{30, 40})
+	is.Equal(s.LastStep, -20.0)
+
+	other := New(10, 2, time.Second, 100*time.Millisecond)
+	other.Restore(s)
+	is.Equal(other.Snapshot(), s)
+	is.Equal(other.Health().Interval, 2*time.Millisecond)
+	is.Equal(other.Health().IntervalStep, 250*time.Microsecond)
+
+	// mutating the snapshot must not change the restored state
+	s.Samples[0] = 0
+	is.Equal(other.Snapshot().Samples, []float64{30, 40})
+}
+
+func TestT_SnapshotRestoreDetectors(t *testing.T) {
+	is := is.New(t)
+
+	memory := Signal{
+		Name:   "memory",
+		L:      90,
+		K:      4,
+		Sample: func() (float64, error) { return 0, errors.New("boom") },
+	}
+	th := New(50, 2, 2*time.Millisecond, 250*time.Microsecond)
+	th.Failsafe = &Failsafe{R: 25, MaxIdleIntervals: 5, MaxSignalErrors: 5}
+	th.Oscillation = &Oscillation{Amplitude: 10, Intervals: 1}
+	th.AddSignal(memory)
+	th.Restore(Snapshot{R: 50})
+
+	th.sampleSignals()
+	th.smu.Lock()
+	th.failsafeSample(0, errors.New("boom"))
+	th.failsafeSample(70, nil)
+	th.adjust([]float64{70}) // 50 -> 10
+	th.adjust([]float64{30}) // 10 -> 50
+	th.adjust(nil)
+	th.smu.Unlock()
+
+	s := th.Snapshot()
+	is.True(s.Oscillating)
+	is.Equal(s.OscillationReversals, 1)
+	is.Equal(s.FailsafeIdleIntervals, 1)
+	is.True(s.HasLastSample)
+	is.Equal(s.LastSample, 70.0)
+	is.Equal(s.SignalErrors, map[string]int{"memory": 1})
+
+	other := New(50, 2, 2*time.Millisecond, 250*time.Microsecond)
+	other.AddSignal(memory)
+	other.Restore(s)
+	is.Equal(other.Snapshot(), s)
+	is.True(other.Health().Oscillating)
+
+	// restoring a clean state resets the detectors
+	th.Restore(Snapshot{R: 100})
+	is.True(!th.Health().Oscillating)
+	s = th.Snapshot()
+	is.Equal(s.FailsafeIdleIntervals, 0)
+	is.Equal(s.SignalErrors, map[string]int{"memory": 0})
+}
+
+func TestT_Shadow(t *testing.T) {
+	is := is.New(t)
+
+	th := New(10, 2, 2*time.Millisecond, 250*time.Microsecond)
+	_, ok := th.ShadowR()
+	is.True(!ok)
+
+	th.SetShadow(30, 4)
+	th.smu.Lock()
+	th.adjust([]float64{20, 20})
+	th.adjust([]float64{40, 40})
+	th.smu.Unlock()
+
+	r, ok := th.ShadowR()
+	is.True(ok)
+	is.Equal(r, 60.0)
+	is.Equal(th.Snapshot().R, 20.0)
+
+	h := th.Health()
+	is.True(h.Shadow)
+	is.Equal(h.ShadowR, 60.0)
+
+	// the shadow R is carried over to an instance with a shadow controller
+	snap := th.Snapshot()
+	is.True(snap.Shadow)
+	other := New(10, 2, 2*time.Millisecond, 250*time.Microsecond)
+	other.SetShadow(30, 4)
+	other.Restore(snap)
+	r, _ = other.ShadowR()
+	is.Equal(r, 60.0)
+
+	th.RemoveShadow()
+	_, ok = th.ShadowR()
+	is.True(!ok)
+	is.True(!th.Health().Shadow)
+}
+
+func TestT_ShadowDuringFailsafe(t *testing.T) {
+	is := is.New(t)
+
+	th := New(75, 2, 2*time.Millisecond, 250*time.Microsecond)
+	th.Failsafe = &Failsafe{R: 25, MaxSignalErrors: 1}
+	th.AddSignal(Signal{
+		Name:   "memory",
+		L:      90,
+		K:      4,
+		Sample: func() (float64, error) { return 0, errors.New("boom") },
+	})
+	th.SetShadow(30, 4)
+
+	// the failsafe rejects the primary R but the shadow
+	// still sees the samples
+	th.sampleSignals()
+	th.smu.Lock()
+	th.adjust([]float64{50})
+	th.smu.Unlock()
+	h := th.Health()
+	is.True(h.FailsafeEngaged)
+	is.Equal(h.ShadowR, 20.0)
+}
+
+func TestT_Failsafe(t *testing.T) {
+	is := is.New(t)
+
+	th := New(10, 2, 2*time.Millisecond, 250*time.Microsecond)
+	th.Failsafe = &Failsafe{R: 25, MaxIdleIntervals: 2, MaxSignalErrors: 3}
+
+	th.smu.Lock()
+	defer th.smu.Unlock()
+
+	// NaN samples make the primary controller compute an invalid R
+	th.failsafeSample(math.NaN(), nil)
+	th.adjust([]float64{math.NaN()})
+	is.True(th.failsafe.engaged)
+	is.Equal(*(*float64)(th.r), 25.0)
+
+	// a valid adjustment gives control back to the primary controller
+	th.adjust([]float64{20})
+	is.True(!th.failsafe.engaged)
+	is.Equal(*(*float64)(th.r), 5.0)
+
+	// intervals without stats
+	th.adjust(nil)
+	is.True(!th.failsafe.engaged)
+	th.adjust(nil)
+	is.True(th.failsafe.engaged)
+	th.adjust([]float64{0})
+	is.True(!th.failsafe.engaged)
+
+	// persistent signal failures
+	for i := 0; i < 3; i++ {
+		th.failsafeSample(0, errors.New("boom"))
+	}
+	is.True(th.failsafe.engaged)
+	is.Equal(*(*float64)(th.r), 25.0)
+}
+
+func TestT_Signals(t *testing.T) {
+	is := is.New(t)
+
+	th := New(75, 2, 2*time.Millisecond, 250*time.Microsecond)
+	th.AddSignal(Signal{
+		Name:   "memory",
+		L:      90,
+		K:      4,
+		Sample: func() (float64, error) { return 95, nil },
+	})
+	th.sampleSignals()
+
+	// CPU is below its limit but memory is not, memory wins
+	th.smu.Lock()
+	th.adjust([]float64{50})
+	th.resetSignals()
+	th.smu.Unlock()
+	is.Equal(th.Snapshot().R, 80.0)
+
+	// memory without samples does not take part in the adjustment
+	th.smu.Lock()
+	th.adjust([]float64{80})
+	th.smu.Unlock()
+	is.Equal(th.Snapshot().R, 70.0)
+}
+
+func TestT_CheckIn(t *testing.T) {
+	is := is.New(t)
+
+	th := New(10, 2, 2*time.Millisecond, 250*time.Microsecond)
+	is.NoErr(th.CheckIn(context.Background()))
+
+	th.YieldR = 20
+	th.Restore(Snapshot{R: 50})
+	is.NoErr(th.CheckIn(context.Background()))
+
+	th.Restore(Snapshot{R: 0})
+	is.Equal(th.CheckIn(context.Background()), ErrYield)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	is.Equal(th.CheckIn(ctx), context.Canceled)
+}
+
+func TestT_MaxConcurrentStreams(t *testing.T) {
+	is := is.New(t)
+
+	th := New(10, 2, 2*time.Millisecond, 250*time.Microsecond)
+	is.Equal(th.MaxConcurrentStreams(250), uint32(250))
+
+	th.Restore(Snapshot{R: 40})
+	is.Equal(th.MaxConcurrentStreams(250), uint32(100))
+
+	th.Restore(Snapshot{R: 0})
+	is.Equal(th.MaxConcurrentStreams(250), uint32(1))
+}
+
+func TestKeyed_Eviction(t *testing.T) {
+	is := is.New(t)
+
+	th := New(10, 2, 2*time.Millisecond, 250*time.Microsecond)
+	k := NewKeyed(th, time.Minute, 2)
+	now := time.Now()
+	k.now = func() time.Time { return now }
+
+	is.True(k.Allow("a"))
+	is.True(k.Allow("b"))
+	is.True(k.Allow("a"))
+	st, ok := k.Stats("a")
+	is.True(ok)
+	is.Equal(st.Admitted, uint64(2))
+
+	// b is the least recently used key
+	k.Allow("c")
+	is.Equal(k.Len(), 2)
+	_, ok = k.Stats("b")
+	is.True(!ok)
+
+	now = now.Add(30 * time.Second)
+	k.Allow("c")
+	now = now.Add(45 * time.Second)
+	is.Equal(k.Evict(), 1)
+	_, ok = k.Stats("a")
+	is.True(!ok)
+	_, ok = k.Stats("c")
+	is.True(ok)
+}
+
+func TestT_Capacity(t *testing.T) {
+	is := is.New(t)
+
+	th := New(80, 2, time.Second, 100*time.Millisecond)
+	is.Equal(th.Capacity(), 0.0)
+
+	// 100 req/s at 40% CPU means 200 req/s at 80%
+	for i := 0; i < 100; i++ {
+		is.True(th.Allow())
+	}
+	th.smu.Lock()
+	th.adjust([]float64{40})
+	th.smu.Unlock()
+	is.Equal(th.Capacity(), 200.0)
+
+	// intervals without allowed requests do not change the estimation
+	th.smu.Lock()
+	th.adjust([]float64{40})
+	th.smu.Unlock()
+	is.Equal(th.Capacity(), 200.0)
+}
+
+func TestT_Oscillation(t *testing.T) {
+	is := is.New(t)
+
+	th := New(50, 2, 2*time.Millisecond, 250*time.Microsecond)
+	th.Oscillation = &Oscillation{Amplitude: 10, Intervals: 2, AutoDamp: true}
+	th.Restore(Snapshot{R: 50})
+
+	th.smu.Lock()
+	th.adjust([]float64{70}) // 50 -> 10
+	th.adjust([]float64{30}) // 10 -> 50
+	th.smu.Unlock()
+	is.True(!th.Health().Oscillating)
+
+	th.smu.Lock()
+	th.adjust([]float64{70}) // 50 -> 10
+	th.smu.Unlock()
+	h := th.Health()
+	is.True(h.Oscillating)
+	is.Equal(h.K, 1.0)
+
+	// the load keeps alternating, K is damped down to
+	// its minimum and stays there
+	prevK := h.K
+	for i := 0; i < 10; i++ {
+		th.smu.Lock()
+		th.adjust([]float64{30 + float64(40*(i%2))})
+		th.smu.Unlock()
+		h = th.Health()
+		is.True(h.Oscillating)
+		is.True(h.K <= prevK)
+		prevK = h.K
+	}
+	is.Equal(h.K, 2.0/16)
+
+	// once the load settles K is restored
+	for i := 0; i < maxDamping; i++ {
+		th.smu.Lock()
+		th.adjust([]float64{50})
+		th.smu.Unlock()
+		is.True(!th.Health().Oscillating)
+	}
+	is.Equal(th.Health().K, 2.0)
+}
+
+func TestT_OscillationDefaultIntervals(t *testing.T) {
+	is := is.New(t)
+
+	th := New(50, 2, 2*time.Millisecond, 250*time.Microsecond)
+	th.Oscillation = &Oscillation{Amplitude: 10, AutoDamp: true}
+
+	// a steady R is not an oscillation
+	th.smu.Lock()
+	for i := 0; i < 6; i++ {
+		th.adjust([]float64{50})
+	}
+	th.smu.Unlock()
+	h := th.Health()
+	is.True(!h.Oscillating)
+	is.Equal(h.K, 2.0)
+
+	th.Restore(Snapshot{R: 50})
+	th.smu.Lock()
+	th.adjust([]float64{70})
+	th.adjust([]float64{30})
+	th.smu.Unlock()
+	is.True(!th.Health().Oscillating)
+	th.smu.Lock()
+	th.adjust([]float64{70})
+	th.smu.Unlock()
+	is.True(th.Health().Oscillating)
+}
+
+func TestT_AutoTune(t *testing.T) {
+	is := is.New(t)
+
+	th := NewAutoTuned(80, 2)
+
+	// stable samples only need the minimum amount of samples
+	th.smu.Lock()
+	th.adjust([]float64{50, 50, 50})
+	th.smu.Unlock()
+	h := th.Health()
+	is.Equal(h.Interval, 500*time.Millisecond)
+	is.Equal(h.IntervalStep, 100*time.Millisecond)
+
+	// noisy samples need more samples, taken more often
+	th.smu.Lock()
+	th.adjust([]float64{40, 60, 40, 60, 40, 60})
+	th.smu.Unlock()
+	h = th.Health()
+	is.Equal(h.Interval, 1200*time.Millisecond)
+	is.Equal(h.IntervalStep, 10*time.Millisecond)
+
+	// samples that do not fit at the fastest ST make T grow up to its maximum
+	th.smu.Lock()
+	th.adjust([]float64{0, 100, 0, 100, 0, 100})
+	th.smu.Unlock()
+	h = th.Health()
+	is.Equal(h.Interval, 10*time.Second)
+	is.Equal(h.IntervalStep, 10*time.Millisecond)
+}
+
+func TestT_ErrorFeedback(t *testing.T) {
+	is := is.New(t)
+
+	th := New(80, 2, 2*time.Millisecond, 250*time.Microsecond)
+	th.EnableErrorFeedback(5, 4, 20)
+
+	report := func(succeeded, failed int) {
+		for i := 0; i < succeeded; i++ {
+			th.ReportResult(false)
+		}
+		for i := 0; i < failed; i++ {
+			th.ReportResult(true)
+		}
+	}
+	adjust := func() float64 {
+		th.smu.Lock()
+		th.adjust([]float64{80})
+		th.smu.Unlock()
+		return th.Snapshot().R
+	}
+
+	// CPU is at its limit but the error rate is not
+	report(90, 10)
+	is.Equal(adjust(), 80.0)
+
+	// the rate is computed over the whole interval, one error
+	// in a thousand requests is below the limit and R is kept
+	report(1000, 1)
+	is.Equal(adjust(), 80.0)
+
+	// not enough results to take the error rate into account
+	th.Restore(Snapshot{R: 100})
+	report(0, 10)
+	is.Equal(adjust(), 100.0)
+
+	// results are counted once
+	is.Equal(adjust(), 100.0)
+}
+
+func TestKeyed_WaitWeightedFair(t *testing.T) {
+	is := is.New(t)
+
+	th := New(10, 2, 2*time.Millisecond, 250*time.Microsecond)
+	th.Restore(Snapshot{R: 0})
+	k := NewKeyed(th, 0, 0)
+	k.SetWeight("a", 2)
+	k.SetWeight("b", 0.8)
+	// c only drives admissions, its weight is so small that
+	// it never gets admitted before a or b
+	k.SetWeight("c", 0.01)
+
+	admitted := make(chan string)
+	wait := func(key string, n int) {
+		for i := 0; i < n; i++ {
+			go func() {
+				is.NoErr(k.Wait(context.Background(), key))
+				admitted <- key
+			}()
+		}
+	}
+	wait("a", 4)
+	wait("b", 2)
+	for k.queued() != 6 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// every allowed call admits the queued request with the smallest
+	// virtual finish time instead of the caller
+	th.Restore(Snapshot{R: 100})
+	order := ""
+	for i := 0; i < 6; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+		is.Equal(k.Wait(ctx, "c"), context.DeadlineExceeded)
+		cancel()
+		order += <-admitted
+	}
+	is.Equal(order, "aabaab")
+	is.Equal(k.queued(), 0)
+
+	// requests go through right away when nothing is queued
+	is.NoErr(k.Wait(context.Background(), "b"))
+}
+
+func TestKeyed_WaitCancel(t *testing.T) {
+	is := is.New(t)
+
+	th := New(10, 2, 2*time.Millisecond, 250*time.Microsecond)
+	th.Restore(Snapshot{R: 0})
+	k := NewKeyed(th, 0, 0)
+
+	ctx1, cancel1 := context.WithCancel(context.Background())
+	ctx2, cancel2 := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- k.Wait(ctx1, "a") }()
+	for k.queued() != 1 {
+		time.Sleep(time.Millisecond)
+	}
+	go func() { done <- k.Wait(ctx2, "a") }()
+	for k.queued() != 2 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// canceling the first request moves the second one forward
+	cancel1()
+	is.Equal(<-done, context.Canceled)
+	k.mu.Lock()
+	is.Equal(k.queue[0].tag, 1.0)
+	is.Equal(k.entries["a"].Value.(*entry).finish, 1.0)
+	k.mu.Unlock()
+
+	cancel2()
+	is.Equal(<-done, context.Canceled)
+	k.mu.Lock()
+	is.Equal(k.entries["a"].Value.(*entry).finish, 0.0)
+	k.mu.Unlock()
+	st, _ := k.Stats("a")
+	is.Equal(st.Throttled, uint64(2))
+}
+
+func (k *Keyed) queued() int {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return k.queue.Len()
+}
+
+func TestCPUTime_Usage(t *testing.T) {
+	is := is.New(t)
+
+	// guest time is already part of user
+	st := cpu.TimesStat{User: 10, System: 5, Iowait: 3, Steal: 2, Guest: 4, GuestNice: 1, Idle: 80}
+	is.Equal(DefaultBusyCPUTimes.busy(st), 20.0)
+	is.Equal(DefaultBusyCPUTimes.usage(st), 20.0)
+
+	// excluded iowait counts as idle
+	is.Equal((DefaultBusyCPUTimes &^ CPUIowait).usage(st), 17.0)
+
+	// excluded steal leaves the total
+	is.Equal((DefaultBusyCPUTimes &^ (CPUSteal | CPUIowait)).usage(st), 15*100/98.0)
+
+	is.Equal(CPUTime(0).usage(st), 0.0)
+	is.Equal(DefaultBusyCPUTimes.usage(cpu.TimesStat{}), 0.0)
+}
+
+func TestT_Middleware(t *testing.T) {
+	is := is.New(t)
+
+	var throttled, priority string
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		throttled, _ = pprof.Label(r.Context(), LabelThrottled)
+		priority, _ = pprof.Label(r.Context(), LabelPriority)
+	})
+	th := New(10, 2, 2*time.Millisecond, 250*time.Microsecond)
+	h := th.Middleware(next, func(r *http.Request) string { return r.Header.Get("X-Priority") })
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("X-Priority", "high")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	is.Equal(rec.Code, http.StatusOK)
+	is.Equal(throttled, "false")
+	is.Equal(priority, "high")
+
+	th.Restore(Snapshot{R: 0})
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	is.Equal(rec.Code, http.StatusServiceUnavailable)
+
+	base := context.Background()
+	th.AllowLabeled(base, "", func(ctx context.Context, allowed bool) {
+		is.True(!allowed)
+		v, _ := pprof.Label(ctx, LabelThrottled)
+		is.Equal(v, "true")
+		_, ok := pprof.Label(ctx, LabelPriority)
+		is.True(!ok)
+	})
+
+	// the labels are attached to the goroutine only during the call
+	goroutineLabeled := func() bool {
+		var buf bytes.Buffer
+		is.NoErr(pprof.Lookup("goroutine").WriteTo(&buf, 1))
+		return strings.Contains(buf.String(), `"throttled":"true"`)
+	}
+	during, after := make(chan struct{}), make(chan struct{})
+	go func() {
+		th.AllowLabeled(base, "", func(context.Context, bool) {
+			during <- struct{}{}
+			<-during
+		})
+		after <- struct{}{}
+		<-after
+	}()
+	<-during
+	is.True(goroutineLabeled())
+	during <- struct{}{}
+	<-after
+	is.True(!goroutineLabeled())
+	after <- struct{}{}
+}
+
+func TestT_AutoTuneStart(t *testing.T) {
+	is := is.New(t)
+
+	for _, at := range []*AutoTune{
+		// no bounds
+		{Precision: 1},
+		// max below min
+		{MinInterval: 10 * time.Millisecond, MaxInterval: 5 * time.Millisecond, Precision: 1},
+		// tiny precision asks for an absurd amount of samples
+		{MinInterval: time.Millisecond, MaxInterval: 20 * time.Millisecond, Precision: 1e-9},
+	} {
+		th := New(80, 2, 2*time.Millisecond, 250*time.Microsecond)
+		th.AutoTune = at
+		var i int
+		th.cpuUsage = func() (float64, error) {
+			i++
+			return float64(40 + 20*(i%2)), nil
+		}
+
+		go th.Start()
+		time.Sleep(30 * time.Millisecond)
+		th.Stop()
+		h := th.Health()
+		is.True(h.Interval > 0)
+		is.True(h.IntervalStep > 0)
+		is.True(h.Interval <= 20*time.Millisecond)
+	}
+}
+
+func TestT_FailsafeSignalErrors(t *testing.T) {
+	is := is.New(t)
+
+	th := New(75, 2, 2*time.Millisecond, 250*time.Microsecond)
+	th.Failsafe = &Failsafe{R: 25, MaxSignalErrors: 2}
+	var sampleErr error
+	th.AddSignal(Signal{
+		Name:   "memory",
+		L:      90,
+		K:      4,
+		Sample: func() (float64, error) { return 50, sampleErr },
+	})
+
+	// CPU usage is fine but memory can not be collected
+	sampleErr = errors.New("boom")
+	th.sampleSignals()
+	is.True(!th.Health().FailsafeEngaged)
+	th.sampleSignals()
+	h := th.Health()
+	is.True(h.FailsafeEngaged)
+	is.Equal(h.R, 25.0)
+
+	// valid CPU usage samples do not disengage it while memory fails
+	th.smu.Lock()
+	th.failsafeSample(20, nil)
+	th.adjust([]float64{20})
+	th.smu.Unlock()
+	h = th.Health()
+	is.True(h.FailsafeEngaged)
+	is.Equal(h.R, 25.0)
+
+	sampleErr = nil
+	th.sampleSignals()
+	th.smu.Lock()
+	th.adjust([]float64{20})
+	th.smu.Unlock()
+	is.True(!th.Health().FailsafeEngaged)
+}
+
+func TestT_ConfigureHTTP2Server(t *testing.T) {
+	is := is.New(t)
+
+	th := New(10, 2, 2*time.Millisecond, 250*time.Microsecond)
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	is.NoErr(th.ConfigureHTTP2Server(ts.Config, nil, 100))
+	ts.TLS = ts.Config.TLSConfig
+	ts.StartTLS()
+	defer ts.Close()
+
+	// advertised opens a new connection and returns the
+	// MAX_CONCURRENT_STREAMS sent by the server in its SETTINGS
+	advertised := func() uint32 {
+		conn, err := tls.Dial("tcp", ts.Listener.Addr().String(), &tls.Config{
+			InsecureSkipVerify: true,
+			NextProtos:         []string{http2.NextProtoTLS},
+		})
+		is.NoErr(err)
+		defer conn.Close()
+		is.Equal(conn.ConnectionState().NegotiatedProtocol, http2.NextProtoTLS)
+
+		_, err = io.WriteString(conn, http2.ClientPreface)
+		is.NoErr(err)
+		fr := http2.NewFramer(conn, conn)
+		is.NoErr(fr.WriteSettings())
+		for {
+			f, err := fr.ReadFrame()
+			is.NoErr(err)
+			if sf, ok := f.(*http2.SettingsFrame); ok && !sf.IsAck() {
+				v, ok := sf.Value(http2.SettingMaxConcurrentStreams)
+				is.True(ok)
+				return v
+			}
+		}
+	}
+
+	is.Equal(advertised(), uint32(100))
+	th.Restore(Snapshot{R: 40})
+	is.Equal(advertised(), uint32(40))
+	th.Restore(Snapshot{R: 0})
+	is.Equal(advertised(), uint32(1))
+}
+
+func TestKeyed_WaitDrain(t *testing.T) {
+	is := is.New(t)
+
+	th := New(10, 2, 2*time.Millisecond, 250*time.Microsecond)
+	th.cpuUsage = func() (float64, error) { return 0, nil }
+	th.Restore(Snapshot{R: 0})
+	k := NewKeyed(th, 0, 0)
+
+	done := make(chan error)
+	go func() { done <- k.Wait(context.Background(), "a") }()
+	for k.queued() != 1 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// R rises without new calls to Wait, the control loop
+	// admits the queued request
+	th.Restore(Snapshot{R: 100})
+	go th.Start()
+	defer th.Stop()
+	select {
+	case err := <-done:
+		is.NoErr(err)
+	case <-time.After(time.Second):
+		t.Fatal("queued request was never admitted")
+	}
+}
+
+func TestKeyed_EvictionKeepsWaiting(t *testing.T) {
+	is := is.New(t)
+
+	th := New(10, 2, 2*time.Millisecond, 250*time.Microsecond)
+	th.Restore(Snapshot{R: 0})
+	k := NewKeyed(th, time.Minute, 1)
+	now := time.Now()
+	k.now = func() time.Time { return now }
+	k.SetWeight("a", 2)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- k.Wait(ctx, "a") }()
+	for k.queued() != 1 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// a is over the TTL and over the maximum but it has a queued request
+	now = now.Add(2 * time.Minute)
+	k.Allow("b")
+	is.Equal(k.Len(), 2)
+	k.mu.Lock()
+	e := k.entries["a"].Value.(*entry)
+	is.Equal(e.weight, 2.0)
+	is.Equal(e.finish, 0.5)
+	k.mu.Unlock()
+
+	// once nothing is queued it can be evicted
+	cancel()
+	is.Equal(<-done, context.Canceled)
+	is.Equal(k.Evict(), 1)
+	_, ok := k.Stats("a")
+	is.True(!ok)
+	_, ok = k.Stats("b")
+	is.True(ok)
+}
+
+func TestT_CheckInConcurrent(t *testing.T) {
+	is := is.New(t)
+
+	th := New(10, 2, 2*time.Millisecond, 250*time.Microsecond)
+	th.YieldR = 50
+	th.Restore(Snapshot{R: 25})
+
+	// run with -race to catch concurrent use of the random source
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				th.CheckIn(context.Background())
+				th.Allow()
+			}
+		}()
+	}
+	wg.Wait()
+	is.Equal(th.Snapshot().R, 25.0)
+}
+
+func TestT_CapacityFreshState(t *testing.T) {
+	is := is.New(t)
+
+	// requests allowed before Start are not part of the first interval
+	th := New(80, 2, 20*time.Millisecond, 5*time.Millisecond)
+	th.cpuUsage = func() (float64, error) { return 40, nil }
+	for i := 0; i < 1000; i++ {
+		th.Allow()
+	}
+	th.ReportResult(true)
+	go th.Start()
+	time.Sleep(30 * time.Millisecond)
+	th.Stop()
+	is.Equal(th.Capacity(), 0.0)
+	succeeded, failed := th.swapResults()
+	is.Equal(succeeded+failed, uint64(0))
+
+	// neither are the ones allowed before a Restore
+	for i := 0; i < 1000; i++ {
+		th.Allow()
+	}
+	th.Restore(Snapshot{R: 100})
+	th.smu.Lock()
+	th.adjust([]float64{40})
+	th.smu.Unlock()
+	is.Equal(th.Capacity(), 0.0)
+}
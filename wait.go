@@ -0,0 +1,196 @@
+package throttler
+
+import (
+	"container/heap"
+	"context"
+	"math"
+	"sort"
+)
+
+// waiter is a request blocked in Keyed.Wait.
+type waiter struct {
+	key string
+	// tag is the virtual finish time, computed from the virtual time
+	// when the request arrived, the finish time of the previous request
+	// of the key and the cost of the request
+	tag   float64
+	vtime float64
+	prev  float64
+	cost  float64
+	index int
+	ready chan struct{}
+}
+
+// waitQueue is a priority queue of waiters ordered by their virtual
+// finish time. It implements heap.Interface.
+type waitQueue []*waiter
+
+func (q waitQueue) Len() int           { return len(q) }
+func (q waitQueue) Less(i, j int) bool { return q[i].tag < q[j].tag }
+func (q waitQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index = i
+	q[j].index = j
+}
+
+func (q *waitQueue) Push(x interface{}) {
+	w := x.(*waiter)
+	w.index = len(*q)
+	*q = append(*q, w)
+}
+
+func (q *waitQueue) Pop() interface{} {
+	old := *q
+	w := old[len(old)-1]
+	old[len(old)-1] = nil
+	w.index = -1
+	*q = old[:len(old)-1]
+	return w
+}
+
+// SetWeight sets the weight of key used when dequeueing requests blocked
+// in Wait. Keys have a weight of 1 by default, a key with a weight of 2
+// gets twice as many requests admitted as a key with a weight of 1 during
+// contention. Weights are lost when the key is evicted.
+func (k *Keyed) SetWeight(key string, weight float64) {
+	if weight <= 0 || math.IsNaN(weight) || math.IsInf(weight, 0) {
+		return
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.touch(key).weight = weight
+}
+
+// Wait blocks until the request for key is allowed to go through or ctx is
+// done, in which case it returns ctx.Err().
+//
+// Every call to Wait is asked to the throttler once, so a fraction R of the
+// calls results in an admission just like with Allow. When there are requests
+// already queued, an admission does not go to the caller but to the queued
+// request with the smallest virtual finish time, which implements weighted
+// fair queuing so that the weights configured with SetWeight are honored
+// during contention instead of the arrival order. While the throttler is
+// started, its control loop also gives every queued request another chance
+// every ST, so queued requests are admitted as R rises even if no new
+// calls to Wait are made.
+func (k *Keyed) Wait(ctx context.Context, key string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	k.mu.Lock()
+	e := k.touch(key)
+	allowed := k.t.Allow()
+	if allowed && k.queue.Len() == 0 {
+		e.Admitted++
+		k.mu.Unlock()
+		return nil
+	}
+
+	w := &waiter{
+		key:   key,
+		cost:  1 / e.weight,
+		vtime: k.vtime,
+		prev:  e.finish,
+		ready: make(chan struct{}),
+	}
+	w.tag = math.Max(w.vtime, w.prev) + w.cost
+	e.finish = w.tag
+	e.waiting++
+	heap.Push(&k.queue, w)
+	if allowed {
+		k.release()
+	}
+	k.mu.Unlock()
+
+	select {
+	case <-w.ready:
+		return nil
+	case <-ctx.Done():
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if w.index < 0 {
+		// the request was admitted while the context was being canceled
+		return nil
+	}
+	k.remove(w)
+	if el, ok := k.entries[key]; ok {
+		el.Value.(*entry).Throttled++
+	}
+	return ctx.Err()
+}
+
+// release admits the queued request with the smallest virtual finish
+// time. The caller must hold k.mu.
+func (k *Keyed) release() {
+	w := heap.Pop(&k.queue).(*waiter)
+	k.vtime = w.tag
+	if el, ok := k.entries[w.key]; ok {
+		e := el.Value.(*entry)
+		e.Admitted++
+		e.waiting--
+	}
+	close(w.ready)
+}
+
+// drain asks the throttler once for every queued request and, for every
+// allowed one, releases the queued request with the smallest virtual finish
+// time. It is called by the control loop of T every ST.
+func (k *Keyed) drain() {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	for n := k.queue.Len(); n > 0 && k.queue.Len() > 0; n-- {
+		if k.t.Allow() {
+			k.release()
+		}
+	}
+}
+
+// addWaitQueue registers k so the control loop drains its queue.
+func (t *T) addWaitQueue(k *Keyed) {
+	t.smu.Lock()
+	defer t.smu.Unlock()
+	t.queues = append(t.queues, k)
+}
+
+// drainWaitQueues drains the queues of every Keyed created on top of t.
+func (t *T) drainWaitQueues() {
+	t.smu.Lock()
+	queues := t.queues
+	t.smu.Unlock()
+	for _, k := range queues {
+		k.drain()
+	}
+}
+
+// remove removes w from the queue and recomputes the virtual finish times
+// of the requests of the same key queued after it, so canceled requests do
+// not push back the ones that are still waiting. The caller must hold k.mu.
+func (k *Keyed) remove(w *waiter) {
+	heap.Remove(&k.queue, w.index)
+
+	var later []*waiter
+	for _, x := range k.queue {
+		if x.key == w.key && x.tag > w.tag {
+			later = append(later, x)
+		}
+	}
+	sort.Slice(later, func(i, j int) bool { return later[i].tag < later[j].tag })
+
+	finish := w.prev
+	for _, x := range later {
+		x.prev = finish
+		x.tag = math.Max(x.vtime, x.prev) + x.cost
+		finish = x.tag
+		heap.Fix(&k.queue, x.index)
+	}
+	if el, ok := k.entries[w.key]; ok {
+		e := el.Value.(*entry)
+		e.waiting--
+		if e.finish >= w.tag {
+			e.finish = finish
+		}
+	}
+}